@@ -0,0 +1,11 @@
+package replicated
+
+// ResumeUpdate routes an operator's ack, delivered over the
+// ServiceControl.ResumeUpdate RPC, to the Updater currently driving
+// serviceID's update, unblocking a Canary strategy paused after its
+// canary batch. It reports whether an in-flight update was found to
+// resume; callers should surface that as a NotFound error rather than a
+// silent no-op.
+func (o *Orchestrator) ResumeUpdate(serviceID string) bool {
+	return ResumeUpdateForService(serviceID)
+}
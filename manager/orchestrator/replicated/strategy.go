@@ -0,0 +1,177 @@
+package replicated
+
+import (
+	"sync"
+
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/log"
+	"golang.org/x/net/context"
+)
+
+// strategy drives a single service update from a set of dirty slots to
+// convergence. It decides how slots are batched and when replacement tasks
+// take over from the tasks they're standing in for, and is responsible for
+// calling u.rollback if it gives up on the update. Updater.Run dispatches
+// to the strategy selected by UpdateConfig.Strategy. execute reports
+// whether the update was interrupted -- stopped, paused, or rolled back --
+// rather than running every dirty slot to completion, so Run knows whether
+// it's safe to mark UpdateStatus COMPLETED.
+type strategy interface {
+	execute(ctx context.Context, u *Updater, dirty []slot) bool
+}
+
+// strategyFor returns the strategy selected by the service's UpdateConfig,
+// defaulting to rolling when none is set.
+func strategyFor(service *api.Service) strategy {
+	update := service.Spec.Update
+	if update == nil {
+		return rollingStrategy{}
+	}
+	switch s := update.Strategy.(type) {
+	case *api.UpdateConfig_Canary:
+		return canaryStrategy{config: s.Canary}
+	case *api.UpdateConfig_BlueGreen:
+		return blueGreenStrategy{config: s.BlueGreen}
+	default:
+		return rollingStrategy{}
+	}
+}
+
+// rollingStrategy is the original "pick N slots, replace, wait Delay,
+// repeat" update, and the default when UpdateConfig.Strategy is unset.
+type rollingStrategy struct{}
+
+func (rollingStrategy) execute(ctx context.Context, u *Updater, dirty []slot) bool {
+	parallelism, delay, monitor, order := u.updateConfig()
+
+	if update := u.activeUpdateConfig(); update != nil && update.AdaptiveParallelism {
+		return u.runAdaptiveBatches(ctx, dirty, delay, monitor, order)
+	}
+
+	return u.runBatches(ctx, dirty, parallelism, delay, monitor, order, false)
+}
+
+// canaryStrategy promotes a small, fixed-size batch of new-spec tasks,
+// then pauses for an operator ack (ResumeUpdate) before continuing the
+// rest of the update as a normal rolling update.
+type canaryStrategy struct {
+	config *api.CanaryConfig
+}
+
+func (s canaryStrategy) execute(ctx context.Context, u *Updater, dirty []slot) bool {
+	parallelism, delay, monitor, order := u.updateConfig()
+
+	count := 1
+	if s.config != nil && s.config.Count > 0 {
+		count = int(s.config.Count)
+	}
+	if count > len(dirty) {
+		count = len(dirty)
+	}
+
+	canary, rest := dirty[:count], dirty[count:]
+
+	if u.runBatches(ctx, canary, count, delay, monitor, order, false) {
+		return true
+	}
+	if len(rest) == 0 {
+		return false
+	}
+
+	log.G(ctx).WithField("service.id", u.newService.ID).Info("canary batch converged, waiting for ResumeUpdate")
+	u.recordPhase(ctx, api.UpdatePhase_PAUSED, nil, "awaiting ResumeUpdate after canary batch")
+	u.setUpdateState(ctx, api.UpdateStatus_PAUSED)
+
+	select {
+	case <-u.resumeChan:
+	case <-u.stopChan:
+		return true
+	case <-ctx.Done():
+		return true
+	}
+
+	u.setUpdateState(ctx, api.UpdateStatus_UPDATING)
+	return u.runBatches(ctx, rest, parallelism, delay, monitor, order, false)
+}
+
+// blueGreenStrategy stands up a full parallel set of new-spec tasks, waits
+// for all of them to converge, then tears down the old set atomically. If
+// any replacement fails to converge, the old set is left running and the
+// service is rolled back.
+type blueGreenStrategy struct {
+	config *api.BlueGreenConfig
+}
+
+func (s blueGreenStrategy) execute(ctx context.Context, u *Updater, dirty []slot) bool {
+	_, _, monitor, _ := u.updateConfig()
+
+	newTasks := make([]*api.Task, len(dirty))
+	for i, sl := range dirty {
+		var old *api.Task
+		if len(sl) != 0 {
+			old = sl[0]
+		}
+		newTasks[i] = newReplacementTask(u.newService, old)
+	}
+
+	converged := make([]bool, len(newTasks))
+	var wg sync.WaitGroup
+	wg.Add(len(newTasks))
+	for i, t := range newTasks {
+		go func(i int, t *api.Task) {
+			defer wg.Done()
+			converged[i] = u.createAndWait(ctx, t, monitor)
+		}(i, t)
+	}
+	wg.Wait()
+
+	select {
+	case <-u.stopChan:
+		return true
+	default:
+	}
+
+	failed := false
+	for _, ok := range converged {
+		if !ok {
+			failed = true
+			break
+		}
+	}
+	if failed {
+		log.G(ctx).WithField("service.id", u.newService.ID).Warn("blue/green cutover failed to converge, tearing down the new set and triggering rollback")
+
+		// Abandon the whole new set, not just the task that failed to
+		// converge: the old set is still serving, and leaving any
+		// replacement running would leak a task outside of either spec's
+		// desired count.
+		var teardown sync.WaitGroup
+		teardown.Add(len(newTasks))
+		for _, t := range newTasks {
+			go func(t *api.Task) {
+				defer teardown.Done()
+				u.shutdownTask(ctx, t)
+			}(t)
+		}
+		teardown.Wait()
+
+		u.rollback(ctx)
+		return true
+	}
+
+	// Every replacement is healthy: cut over to the new set atomically.
+	var teardown sync.WaitGroup
+	for _, sl := range dirty {
+		if len(sl) == 0 {
+			continue
+		}
+		teardown.Add(1)
+		go func(old *api.Task) {
+			defer teardown.Done()
+			u.shutdownTask(ctx, old)
+		}(sl[0])
+	}
+	teardown.Wait()
+
+	return false
+}
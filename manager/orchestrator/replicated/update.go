@@ -0,0 +1,828 @@
+package replicated
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/docker/go-events"
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/identity"
+	"github.com/docker/swarmkit/log"
+	"github.com/docker/swarmkit/manager/state"
+	"github.com/docker/swarmkit/manager/state/store"
+	"github.com/docker/swarmkit/protobuf/ptypes"
+	"golang.org/x/net/context"
+)
+
+// slot is the set of tasks occupying a single replicated slot. Under the
+// default STOP_FIRST ordering it holds at most one task at a time; under
+// START_FIRST it may briefly hold both the old and the replacement task
+// while the replacement is starting up.
+type slot []*api.Task
+
+// Updater brings a set of slots in line with a new service spec, using the
+// strategy selected by UpdateConfig.Strategy (rolling, canary or
+// blue/green; rolling is the default), and triggers a rollback if the
+// ratio of failed replacements exceeds MaxFailureRatio. A replacement task
+// only counts as converged once it reaches RUNNING and, if its container
+// defines a healthcheck, the healthcheck reports healthy; an unhealthy
+// report counts the same as a crashed task toward MaxFailureRatio.
+type Updater struct {
+	store *store.MemoryStore
+
+	newService *api.Service
+
+	// updatedTasks records the IDs of the tasks this Updater has created.
+	// Nothing reads it back: Run skips slots that were already replaced
+	// through dirtySlots, not through this map.
+	updatedTasks   map[string]struct{}
+	updatedTasksMu sync.Mutex
+
+	// resumeChan is signalled by ResumeUpdate to let a strategy that pauses
+	// for operator input (Canary) proceed.
+	resumeChan chan struct{}
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// NewUpdater creates an Updater that will converge slots toward newService.
+func NewUpdater(store *store.MemoryStore, newService *api.Service) *Updater {
+	return &Updater{
+		store:        store,
+		newService:   newService,
+		updatedTasks: make(map[string]struct{}),
+		resumeChan:   make(chan struct{}, 1),
+		stopChan:     make(chan struct{}),
+		doneChan:     make(chan struct{}),
+	}
+}
+
+// Stop cancels the update and waits for Run to return.
+func (u *Updater) Stop() {
+	close(u.stopChan)
+	<-u.doneChan
+}
+
+// ResumeUpdate unblocks a Canary strategy that is paused waiting for
+// operator approval to continue past its canary batch. It is invoked by
+// the ServiceControl.ResumeUpdate RPC handler. It has no effect on
+// strategies that never pause.
+func (u *Updater) ResumeUpdate() {
+	select {
+	case u.resumeChan <- struct{}{}:
+	default:
+	}
+}
+
+// activeUpdaters tracks the Updater currently driving each service's
+// update, keyed by service ID. It lets Orchestrator.ResumeUpdate route an
+// operator's ack, delivered over the ServiceControl.ResumeUpdate RPC, to
+// the right in-flight Updater without the RPC handler needing direct
+// access to it.
+var (
+	activeUpdatersMu sync.Mutex
+	activeUpdaters   = make(map[string]*Updater)
+)
+
+// register makes u reachable by service ID through ResumeUpdateForService
+// for as long as Run is in flight.
+func (u *Updater) register() {
+	activeUpdatersMu.Lock()
+	activeUpdaters[u.newService.ID] = u
+	activeUpdatersMu.Unlock()
+}
+
+// unregister removes u, unless some later Updater for the same service has
+// already replaced it in the registry.
+func (u *Updater) unregister() {
+	activeUpdatersMu.Lock()
+	if activeUpdaters[u.newService.ID] == u {
+		delete(activeUpdaters, u.newService.ID)
+	}
+	activeUpdatersMu.Unlock()
+}
+
+// ResumeUpdateForService delivers a ResumeUpdate ack to the Updater
+// currently running for serviceID, if any, and reports whether one was
+// found. It's the entry point Orchestrator.ResumeUpdate calls into from
+// the ServiceControl.ResumeUpdate RPC handler.
+func ResumeUpdateForService(serviceID string) bool {
+	activeUpdatersMu.Lock()
+	u := activeUpdaters[serviceID]
+	activeUpdatersMu.Unlock()
+	if u == nil {
+		return false
+	}
+	u.ResumeUpdate()
+	return true
+}
+
+// Run updates slots to match the Updater's service spec, using the
+// strategy selected by UpdateConfig.Strategy (rolling, by default). It
+// returns once every dirty slot has been updated, the update was cancelled
+// via Stop, or a rollback was triggered.
+//
+// Run is safe to call again for a service whose UpdateStatus.History
+// already records a partial update, for example after a manager restart:
+// since dirtySlots only returns slots that don't yet match the target
+// spec, slots a previous Run already replaced are skipped rather than
+// scheduled a second time.
+func (u *Updater) Run(ctx context.Context, slots []slot) {
+	defer close(u.doneChan)
+
+	dirty := u.dirtySlots(slots)
+	if len(dirty) == 0 {
+		return
+	}
+
+	u.register()
+	defer u.unregister()
+
+	if resumingRollback(u.newService) {
+		// A previous run already reverted Spec and started rolling back,
+		// then was interrupted (a manager restart, say) before finishing.
+		// Keep driving that same rollback instead of treating dirty as a
+		// fresh forward update.
+		u.finishRollback(ctx, dirty)
+		return
+	}
+
+	if !u.alreadyStarted() {
+		u.recordPhase(ctx, api.UpdatePhase_STARTED, nil, "")
+	}
+	u.setUpdateState(ctx, api.UpdateStatus_UPDATING)
+
+	if interrupted := strategyFor(u.newService).execute(ctx, u, dirty); !interrupted {
+		u.setUpdateState(ctx, api.UpdateStatus_COMPLETED)
+	}
+}
+
+// resumingRollback reports whether service's persisted UpdateStatus shows
+// a rollback already in progress, which is the case when Run is resuming
+// across a manager restart that interrupted one.
+func resumingRollback(service *api.Service) bool {
+	if service.UpdateStatus == nil {
+		return false
+	}
+	switch service.UpdateStatus.State {
+	case api.UpdateStatus_ROLLBACK_STARTED, api.UpdateStatus_ROLLBACK_PAUSED:
+		return true
+	default:
+		return false
+	}
+}
+
+// alreadyStarted reports whether the service's persisted history already
+// has a STARTED entry for the update currently in progress, which is the
+// case when Run is resuming an update across a manager restart rather
+// than beginning one.
+func (u *Updater) alreadyStarted() bool {
+	if u.newService.UpdateStatus == nil {
+		return false
+	}
+	for _, phase := range u.newService.UpdateStatus.History {
+		if phase.Type == api.UpdatePhase_STARTED {
+			return true
+		}
+	}
+	return false
+}
+
+// recordPhase appends an UpdatePhase entry to the service's persisted
+// UpdateStatus.History, so update progress survives a manager restart and
+// can be replayed to a client over WatchServiceUpdate.
+func (u *Updater) recordPhase(ctx context.Context, kind api.UpdatePhase_Type, taskIDs []string, reason string) {
+	phase := &api.UpdatePhase{
+		Type:      kind,
+		Timestamp: ptypes.MustTimestampProto(time.Now()),
+		TaskIDs:   taskIDs,
+		Reason:    reason,
+	}
+
+	err := u.store.Update(func(tx store.Tx) error {
+		service := store.GetService(tx, u.newService.ID)
+		if service == nil {
+			return nil
+		}
+		if service.UpdateStatus == nil {
+			service.UpdateStatus = &api.UpdateStatus{}
+		}
+		service.UpdateStatus.History = append(service.UpdateStatus.History, phase)
+		return store.UpdateService(tx, service)
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", u.newService.ID).Error("failed to persist update phase")
+	}
+}
+
+// setUpdateState persists state as the service's UpdateStatus.State, so
+// update progress (UPDATING, PAUSED, COMPLETED, and the ROLLBACK_*
+// variants) is visible to WatchServiceUpdate and survives a manager
+// restart.
+func (u *Updater) setUpdateState(ctx context.Context, state api.UpdateStatus_UpdateState) {
+	err := u.store.Update(func(tx store.Tx) error {
+		service := store.GetService(tx, u.newService.ID)
+		if service == nil {
+			return nil
+		}
+		if service.UpdateStatus == nil {
+			service.UpdateStatus = &api.UpdateStatus{}
+		}
+		service.UpdateStatus.State = state
+		return store.UpdateService(tx, service)
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", u.newService.ID).Error("failed to persist update state")
+	}
+}
+
+// failureAction returns the FailureAction the active update config
+// specifies for a MaxFailureRatio breach, defaulting to PAUSE (the zero
+// value) when none is set.
+func (u *Updater) failureAction() api.UpdateConfig_FailureAction {
+	if update := u.activeUpdateConfig(); update != nil {
+		return update.FailureAction
+	}
+	return api.UpdateConfig_PAUSE
+}
+
+// activeUpdateConfig returns the UpdateConfig that governs the update
+// currently in progress. While rolling back (UpdateStatus.State is
+// ROLLBACK_STARTED or ROLLBACK_PAUSED) it's Spec.Rollback, when the
+// service defines one; otherwise it's the forward update's Spec.Update.
+// This is what lets a rollback use its own order, parallelism, delay and
+// failure threshold instead of always reusing the forward update's.
+func (u *Updater) activeUpdateConfig() *api.UpdateConfig {
+	service := u.newService
+	if service.UpdateStatus != nil {
+		switch service.UpdateStatus.State {
+		case api.UpdateStatus_ROLLBACK_STARTED, api.UpdateStatus_ROLLBACK_PAUSED:
+			if service.Spec.Rollback != nil {
+				return service.Spec.Rollback
+			}
+		}
+	}
+	return service.Spec.Update
+}
+
+// updateConfig reads the knobs common to every strategy off
+// activeUpdateConfig, defaulting zero values the way the rolling strategy
+// always has: no parallelism cap and no delay or monitor window.
+func (u *Updater) updateConfig() (parallelism int, delay, monitor time.Duration, order api.UpdateConfig_UpdateOrder) {
+	update := u.activeUpdateConfig()
+	if update == nil {
+		return 0, 0, 0, api.UpdateConfig_STOP_FIRST
+	}
+	parallelism = int(update.Parallelism)
+	order = update.Order
+	if d, err := ptypes.Duration(&update.Delay); err == nil {
+		delay = d
+	}
+	if update.Monitor != nil {
+		if d, err := ptypes.Duration(update.Monitor); err == nil {
+			monitor = d
+		}
+	}
+	return
+}
+
+// runBatches updates slots in batches of parallelism, waiting delay
+// between batches. If MaxFailureRatio is exceeded, a forward update
+// (isRollback false) applies FailureAction -- CONTINUE keeps going, PAUSE
+// stops and pauses, and ROLLBACK (or any other value) stops and rolls
+// back -- while a rollback
+// (isRollback true) always stops and pauses, since there's no sense
+// rolling back a rollback. It reports whether the loop stopped early.
+func (u *Updater) runBatches(ctx context.Context, slots []slot, parallelism int, delay, monitor time.Duration, order api.UpdateConfig_UpdateOrder, isRollback bool) bool {
+	if parallelism <= 0 {
+		parallelism = len(slots)
+	}
+
+	maxFailureRatio := float32(0)
+	if update := u.activeUpdateConfig(); update != nil {
+		maxFailureRatio = update.MaxFailureRatio
+	}
+
+	var failures, totalAttempts int
+
+	for i := 0; i < len(slots); i += parallelism {
+		batchNum := i/parallelism + 1
+		batch := slots[i:min(i+parallelism, len(slots))]
+
+		u.recordPhase(ctx, api.UpdatePhase_BATCH_STARTED, nil, fmt.Sprintf("batch %d", batchNum))
+
+		converged := make([]bool, len(batch))
+		taskIDs := make([]string, len(batch))
+		var wg sync.WaitGroup
+		wg.Add(len(batch))
+		for idx, s := range batch {
+			go func(idx int, s slot) {
+				defer wg.Done()
+				converged[idx], taskIDs[idx] = u.updateSlot(ctx, order, monitor, s)
+			}(idx, s)
+		}
+		wg.Wait()
+
+		select {
+		case <-u.stopChan:
+			return true
+		default:
+		}
+
+		for _, ok := range converged {
+			totalAttempts++
+			if !ok {
+				failures++
+			}
+		}
+
+		if maxFailureRatio != 0 && float32(failures)/float32(totalAttempts) > maxFailureRatio {
+			if isRollback {
+				log.G(ctx).WithField("service.id", u.newService.ID).Warn("rollback failed to converge, pausing")
+				u.recordPhase(ctx, api.UpdatePhase_PAUSED, taskIDs, "rollback failed to converge")
+				u.setUpdateState(ctx, api.UpdateStatus_ROLLBACK_PAUSED)
+				return true
+			}
+
+			switch u.failureAction() {
+			case api.UpdateConfig_CONTINUE:
+				log.G(ctx).WithField("service.id", u.newService.ID).Warn("update failure ratio exceeded, continuing since FailureAction is CONTINUE")
+			case api.UpdateConfig_PAUSE:
+				log.G(ctx).WithField("service.id", u.newService.ID).Warn("update failure ratio exceeded, pausing")
+				u.recordPhase(ctx, api.UpdatePhase_PAUSED, taskIDs, "max failure ratio exceeded")
+				u.setUpdateState(ctx, api.UpdateStatus_PAUSED)
+				return true
+			default:
+				log.G(ctx).WithField("service.id", u.newService.ID).Warn("update failure ratio exceeded, triggering rollback")
+				u.recordPhase(ctx, api.UpdatePhase_ROLLBACK_STARTED, taskIDs, "max failure ratio exceeded")
+				u.rollback(ctx)
+				return true
+			}
+		}
+
+		u.recordPhase(ctx, api.UpdatePhase_BATCH_COMPLETED, taskIDs, fmt.Sprintf("batch %d", batchNum))
+
+		if i+parallelism < len(slots) {
+			select {
+			case <-time.After(delay):
+			case <-u.stopChan:
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// runAdaptiveBatches drives slots with an AIMD-adjusted batch size instead
+// of a fixed Parallelism: it starts at 1 and doubles after every
+// fully-converged batch (capped at MaxParallelism), and halves (floor 1)
+// and extends the delay after any batch containing a failure. The backoff
+// is decided from whether the batch just run had a failure; no running
+// failure count is kept for it. The only running count is the one that
+// trips MaxFailureRatio across the whole run, so a batch can back off
+// without rolling back.
+func (u *Updater) runAdaptiveBatches(ctx context.Context, slots []slot, delay, monitor time.Duration, order api.UpdateConfig_UpdateOrder) bool {
+	update := u.activeUpdateConfig()
+
+	maxParallelism := len(slots)
+	if update != nil && update.MaxParallelism > 0 {
+		maxParallelism = int(update.MaxParallelism)
+	}
+	maxFailureRatio := float32(0)
+	if update != nil {
+		maxFailureRatio = update.MaxFailureRatio
+	}
+
+	var history []*api.UpdatePhase
+	if u.newService.UpdateStatus != nil {
+		history = u.newService.UpdateStatus.History
+	}
+	batchSize := resumeBatchSize(history, maxParallelism)
+	batchDelay := delay
+
+	var failures, totalAttempts int
+	for i := 0; i < len(slots); {
+		batch := slots[i:min(i+batchSize, len(slots))]
+
+		u.recordPhase(ctx, api.UpdatePhase_BATCH_STARTED, nil, fmt.Sprintf("batch size %d", len(batch)))
+
+		converged := make([]bool, len(batch))
+		taskIDs := make([]string, len(batch))
+		var wg sync.WaitGroup
+		wg.Add(len(batch))
+		for idx, s := range batch {
+			go func(idx int, s slot) {
+				defer wg.Done()
+				converged[idx], taskIDs[idx] = u.updateSlot(ctx, order, monitor, s)
+			}(idx, s)
+		}
+		wg.Wait()
+
+		select {
+		case <-u.stopChan:
+			return true
+		default:
+		}
+
+		batchFailed := false
+		for _, ok := range converged {
+			totalAttempts++
+			if !ok {
+				failures++
+				batchFailed = true
+			}
+		}
+
+		if maxFailureRatio != 0 && float32(failures)/float32(totalAttempts) > maxFailureRatio {
+			switch u.failureAction() {
+			case api.UpdateConfig_CONTINUE:
+				log.G(ctx).WithField("service.id", u.newService.ID).Warn("update failure ratio exceeded, continuing since FailureAction is CONTINUE")
+			case api.UpdateConfig_PAUSE:
+				log.G(ctx).WithField("service.id", u.newService.ID).Warn("update failure ratio exceeded, pausing")
+				u.recordPhase(ctx, api.UpdatePhase_PAUSED, taskIDs, "max failure ratio exceeded")
+				u.setUpdateState(ctx, api.UpdateStatus_PAUSED)
+				return true
+			default:
+				log.G(ctx).WithField("service.id", u.newService.ID).Warn("update failure ratio exceeded, triggering rollback")
+				u.recordPhase(ctx, api.UpdatePhase_ROLLBACK_STARTED, taskIDs, "max failure ratio exceeded")
+				u.rollback(ctx)
+				return true
+			}
+		}
+
+		u.recordPhase(ctx, api.UpdatePhase_BATCH_COMPLETED, taskIDs, fmt.Sprintf("batch size %d", len(batch)))
+
+		i += len(batch)
+
+		if batchFailed {
+			batchSize = max(batchSize/2, 1)
+			batchDelay = delay * 2
+		} else {
+			batchSize = min(batchSize*2, maxParallelism)
+			batchDelay = delay
+		}
+
+		if i < len(slots) {
+			log.G(ctx).WithField("service.id", u.newService.ID).Debugf("adaptive parallelism: next batch size %d", batchSize)
+			select {
+			case <-time.After(batchDelay):
+			case <-u.stopChan:
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// resumeBatchSize reconstructs the batch size runAdaptiveBatches should
+// begin at when resuming an update -- after a manager restart, for
+// example -- instead of always restarting AIMD at 1. It reads the tail of
+// the persisted UpdateStatus.History left by a previous run:
+// runAdaptiveBatches records each batch's size as "batch size N" in
+// BATCH_STARTED and BATCH_COMPLETED's Reason (runBatches records the batch
+// number as "batch N" instead, and those entries are skipped), so the last
+// recorded size, and whether it got
+// a matching BATCH_COMPLETED, is enough to tell whether AIMD should
+// continue growing or back off as if that batch had failed.
+func resumeBatchSize(history []*api.UpdatePhase, maxParallelism int) int {
+	var lastSize int
+	completed := true
+	for _, phase := range history {
+		var size int
+		if _, err := fmt.Sscanf(phase.Reason, "batch size %d", &size); err != nil || size <= 0 {
+			continue
+		}
+		switch phase.Type {
+		case api.UpdatePhase_BATCH_STARTED:
+			lastSize = size
+			completed = false
+		case api.UpdatePhase_BATCH_COMPLETED:
+			completed = true
+		}
+	}
+	if lastSize == 0 {
+		return 1
+	}
+	if completed {
+		return min(lastSize*2, maxParallelism)
+	}
+	// The last recorded batch never got a matching BATCH_COMPLETED: the
+	// manager was restarted mid-batch. Treat it like a failed batch and
+	// back off, the same as a live run would have.
+	return max(lastSize/2, 1)
+}
+
+// currentSlots reads serviceID's present tasks and groups them by Slot,
+// the shape Run and rollback operate on, skipping tasks already winding
+// down (DesiredState beyond RUNNING) so a teardown in flight from the
+// update being rolled back isn't mistaken for a live occupant.
+func currentSlots(tx store.ReadTx, serviceID string) ([]slot, error) {
+	tasks, err := store.FindTasks(tx, store.ByServiceID(serviceID))
+	if err != nil {
+		return nil, err
+	}
+
+	bySlot := make(map[uint64]slot)
+	for _, t := range tasks {
+		if t.DesiredState > api.TaskStateRunning {
+			continue
+		}
+		bySlot[t.Slot] = append(bySlot[t.Slot], t)
+	}
+
+	slots := make([]slot, 0, len(bySlot))
+	for _, s := range bySlot {
+		slots = append(slots, s)
+	}
+	return slots, nil
+}
+
+// dirtySlots returns the slots whose current task doesn't already match the
+// Updater's service spec.
+func (u *Updater) dirtySlots(slots []slot) []slot {
+	var dirty []slot
+	for _, s := range slots {
+		if len(s) == 0 || isTaskDirty(u.newService, s[0]) {
+			dirty = append(dirty, s)
+		}
+	}
+	return dirty
+}
+
+func isTaskDirty(service *api.Service, t *api.Task) bool {
+	return !reflect.DeepEqual(t.Spec, service.Spec.Task)
+}
+
+// updateSlot replaces the task occupying s with one matching the Updater's
+// service spec, following the ordering configured on UpdateConfig.Order. It
+// reports whether the replacement converged: reached RUNNING and then, if a
+// healthcheck is configured, went healthy (monitor does not bound that
+// wait), or, if none is, ran for monitor without failing.
+func (u *Updater) updateSlot(ctx context.Context, order api.UpdateConfig_UpdateOrder, monitor time.Duration, s slot) (converged bool, newTaskID string) {
+	var oldTask *api.Task
+	if len(s) != 0 {
+		oldTask = s[0]
+	}
+
+	newTask := newReplacementTask(u.newService, oldTask)
+
+	if order == api.UpdateConfig_START_FIRST {
+		// Start the replacement and wait for it to come up before tearing
+		// down the old task, so capacity never dips during the update.
+		if !u.createAndWait(ctx, newTask, monitor) {
+			return false, newTask.ID
+		}
+		if oldTask != nil {
+			u.shutdownTask(ctx, oldTask)
+		}
+		return true, newTask.ID
+	}
+
+	// STOP_FIRST (the default): tear down the old task before starting the
+	// replacement.
+	if oldTask != nil {
+		u.shutdownTask(ctx, oldTask)
+	}
+	return u.createAndWait(ctx, newTask, monitor), newTask.ID
+}
+
+// createAndWait creates t and blocks until it converges: it reaches
+// RUNNING, and then either its healthcheck (if any) reports healthy or, if
+// no healthcheck is configured, the monitor window elapses without a
+// failure. It returns false if t failed, went unhealthy, or the update was
+// cancelled.
+func (u *Updater) createAndWait(ctx context.Context, t *api.Task, monitor time.Duration) bool {
+	taskUpdates, cancel := state.Watch(u.store.WatchQueue(), state.EventUpdateTask{
+		Task: &api.Task{ID: t.ID},
+	})
+	defer cancel()
+
+	if err := u.store.Update(func(tx store.Tx) error {
+		return store.CreateTask(tx, t)
+	}); err != nil {
+		log.G(ctx).WithError(err).WithField("task.id", t.ID).Error("update failed to create replacement task")
+		return false
+	}
+
+	u.recordUpdated(t.ID)
+
+	for {
+		select {
+		case e := <-taskUpdates:
+			updated := e.(state.EventUpdateTask).Task
+			if updated.Status.State == api.TaskStateFailed {
+				return false
+			}
+			if updated.Status.State == api.TaskStateRunning {
+				return u.waitForHealthy(ctx, updated, taskUpdates, monitor)
+			}
+		case <-u.stopChan:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// waitForHealthy blocks until the task's container healthcheck (if any)
+// reports healthy, it is reported unhealthy or failed, or, when there is no
+// healthcheck configured, the monitor window elapses. current is the task
+// snapshot that just reached RUNNING on taskUpdates: a healthcheck can
+// report in the very same event that reports RUNNING, so current must be
+// checked before blocking on taskUpdates again, or that report is lost and
+// waitForHealthy hangs waiting for an update that will never come.
+func (u *Updater) waitForHealthy(ctx context.Context, current *api.Task, taskUpdates chan events.Event, monitor time.Duration) bool {
+	hasHealthcheck := u.newService.Spec.Task.GetContainer().GetHealthcheck() != nil
+	if !hasHealthcheck && monitor <= 0 {
+		return true
+	}
+
+	if resolved, healthy := healthResult(current, hasHealthcheck); resolved {
+		return healthy
+	}
+
+	var timeout <-chan time.Time
+	if !hasHealthcheck {
+		timer := time.NewTimer(monitor)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case e := <-taskUpdates:
+			updated := e.(state.EventUpdateTask).Task
+			if resolved, healthy := healthResult(updated, hasHealthcheck); resolved {
+				return healthy
+			}
+		case <-timeout:
+			// No healthcheck configured: the monitor window elapsing with
+			// no failure is the signal that the task has converged.
+			return true
+		case <-u.stopChan:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// healthResult inspects a task snapshot for a result that should end
+// waitForHealthy's loop: a hard failure, or, when a healthcheck is
+// configured, a healthcheck success or failure report. resolved is false
+// when the snapshot settles nothing and the caller should keep waiting.
+func healthResult(t *api.Task, hasHealthcheck bool) (resolved, healthy bool) {
+	if t.Status.State == api.TaskStateFailed {
+		return true, false
+	}
+	if !hasHealthcheck {
+		return false, false
+	}
+	switch t.Status.HealthState {
+	case api.HealthCheckSuccess:
+		return true, true
+	case api.HealthCheckFailure:
+		return true, false
+	}
+	return false, false
+}
+
+// shutdownTask moves t toward removal and waits for it to leave RUNNING.
+func (u *Updater) shutdownTask(ctx context.Context, t *api.Task) {
+	taskUpdates, cancel := state.Watch(u.store.WatchQueue(), state.EventUpdateTask{
+		Task: &api.Task{ID: t.ID},
+	})
+	defer cancel()
+
+	if err := u.store.Update(func(tx store.Tx) error {
+		t = store.GetTask(tx, t.ID)
+		if t == nil {
+			return nil
+		}
+		t.DesiredState = api.TaskStateShutdown
+		return store.UpdateTask(tx, t)
+	}); err != nil {
+		log.G(ctx).WithError(err).WithField("task.id", t.ID).Error("update failed to shut down old task")
+		return
+	}
+
+	for {
+		select {
+		case e := <-taskUpdates:
+			updated := e.(state.EventUpdateTask).Task
+			if updated.Status.State >= api.TaskStateShutdown {
+				return
+			}
+		case <-u.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (u *Updater) recordUpdated(taskID string) {
+	u.updatedTasksMu.Lock()
+	u.updatedTasks[taskID] = struct{}{}
+	u.updatedTasksMu.Unlock()
+}
+
+// rollback reverts the service to its PreviousSpec and drives the slots
+// back to it, reusing this same Updater rather than spinning up a new one:
+// u.newService needs to move to the reverted spec too,
+// since this Updater keeps running afterward (Run calls finishRollback
+// directly, and a restart resumes here via resumingRollback).
+func (u *Updater) rollback(ctx context.Context) {
+	var service *api.Service
+	reverted := false
+	err := u.store.Update(func(tx store.Tx) error {
+		service = store.GetService(tx, u.newService.ID)
+		if service == nil || service.PreviousSpec == nil {
+			return nil
+		}
+		service.Spec = *service.PreviousSpec.Copy()
+		service.PreviousSpec = nil
+		if service.UpdateStatus == nil {
+			service.UpdateStatus = &api.UpdateStatus{}
+		}
+		service.UpdateStatus.State = api.UpdateStatus_ROLLBACK_STARTED
+		reverted = true
+		return store.UpdateService(tx, service)
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", u.newService.ID).Error("failed to persist rollback spec")
+		return
+	}
+	if !reverted {
+		return
+	}
+	u.newService = service
+
+	var (
+		slots   []slot
+		viewErr error
+	)
+	u.store.View(func(tx store.ReadTx) {
+		slots, viewErr = currentSlots(tx, service.ID)
+	})
+	if viewErr != nil {
+		log.G(ctx).WithError(viewErr).WithField("service.id", u.newService.ID).Error("failed to read slots for rollback")
+		return
+	}
+
+	u.finishRollback(ctx, u.dirtySlots(slots))
+}
+
+// finishRollback drives dirty back to the reverted spec rollback just put
+// in place, then records how the rollback ended: ROLLBACK_COMPLETED once
+// every slot matches it, or, if the rollback's own replacement tasks fail
+// MaxFailureRatio, ROLLBACK_PAUSED -- runBatches has already recorded that
+// transition itself in that case, since only it knows the rollback failed
+// partway through a batch rather than never started.
+func (u *Updater) finishRollback(ctx context.Context, dirty []slot) {
+	if len(dirty) == 0 {
+		u.setUpdateState(ctx, api.UpdateStatus_ROLLBACK_COMPLETED)
+		return
+	}
+
+	parallelism, delay, monitor, order := u.updateConfig()
+	if u.runBatches(ctx, dirty, parallelism, delay, monitor, order, true) {
+		return
+	}
+	u.setUpdateState(ctx, api.UpdateStatus_ROLLBACK_COMPLETED)
+}
+
+func newReplacementTask(service *api.Service, old *api.Task) *api.Task {
+	t := &api.Task{
+		ID:           identity.NewID(),
+		Spec:         *service.Spec.Task.Copy(),
+		ServiceID:    service.ID,
+		DesiredState: api.TaskStateRunning,
+		Status: api.TaskStatus{
+			State: api.TaskStateNew,
+		},
+	}
+	if old != nil {
+		t.Slot = old.Slot
+	}
+	return t
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
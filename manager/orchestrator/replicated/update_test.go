@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/docker/go-events"
 	"github.com/docker/swarmkit/api"
 	"github.com/docker/swarmkit/manager/orchestrator/testutils"
 	"github.com/docker/swarmkit/manager/state"
@@ -257,3 +258,1005 @@ func TestUpdaterRollback(t *testing.T) {
 		}
 	}
 }
+
+// TestUpdaterRollbackStartFirst is analogous to TestUpdaterRollback, but
+// exercises UpdateConfig_START_FIRST: during a forward update, the
+// replacement task for a slot must be created while the old task is still
+// present. It then fails a second update's replacements and checks that
+// the rollback this triggers creates tasks with the previous spec.
+func TestUpdaterRollbackStartFirst(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s)
+	defer orchestrator.Stop()
+
+	var failImage3 uint32
+
+	watchCreate, cancelCreate := state.Watch(s.WatchQueue(), state.EventCreateTask{})
+	defer cancelCreate()
+
+	watchServiceUpdate, cancelServiceUpdate := state.Watch(s.WatchQueue(), state.EventUpdateService{})
+	defer cancelServiceUpdate()
+
+	watchUpdate, cancelUpdate := state.Watch(s.WatchQueue(), state.EventUpdateTask{})
+	defer cancelUpdate()
+	go func() {
+		for {
+			select {
+			case e := <-watchUpdate:
+				task := e.(state.EventUpdateTask).Task
+				if task.DesiredState == task.Status.State {
+					continue
+				}
+				if task.DesiredState == api.TaskStateRunning && task.Status.State != api.TaskStateFailed && task.Status.State != api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						if task.Spec.GetContainer().Image == "image3" && atomic.LoadUint32(&failImage3) == 1 {
+							task.Status.State = api.TaskStateFailed
+						} else {
+							task.Status.State = task.DesiredState
+						}
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				} else if task.DesiredState > api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				}
+			}
+		}
+	}()
+
+	err := s.Update(func(tx store.Tx) error {
+		s1 := &api.Service{
+			ID: "id2",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{
+					Name: "name2",
+				},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{
+						Container: &api.ContainerSpec{
+							Image: "image1",
+						},
+					},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnNone,
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{
+					Replicated: &api.ReplicatedService{
+						Replicas: 2,
+					},
+				},
+				Update: &api.UpdateConfig{
+					FailureAction:   api.UpdateConfig_ROLLBACK,
+					Order:           api.UpdateConfig_START_FIRST,
+					Parallelism:     1,
+					Delay:           *ptypes.DurationProto(10 * time.Millisecond),
+					Monitor:         ptypes.DurationProto(500 * time.Millisecond),
+					MaxFailureRatio: 0.4,
+				},
+			},
+		}
+
+		assert.NoError(t, store.CreateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	go func() {
+		assert.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	testutils.WatchTaskCreate(t, watchCreate)
+	testutils.WatchTaskCreate(t, watchCreate)
+
+	// Start a forward update that always succeeds. With START_FIRST, the
+	// new task for a slot must be created (and running) while the old
+	// task occupying that slot is still present, instead of the old task
+	// being torn down first.
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id2")
+		require.NotNil(t, s1)
+		s1.PreviousSpec = s1.Spec.Copy()
+		s1.UpdateStatus = nil
+		s1.Spec.Task.GetContainer().Image = "image2"
+		assert.NoError(t, store.UpdateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		observedTask := testutils.WatchTaskCreate(t, watchCreate)
+		assert.Equal(t, observedTask.Status.State, api.TaskStateNew)
+		assert.Equal(t, observedTask.Spec.GetContainer().Image, "image2")
+
+		var oldStillPresent bool
+		err = s.Update(func(tx store.Tx) error {
+			tasks, findErr := store.FindTasks(tx, store.ByServiceID("id2"))
+			if findErr != nil {
+				return findErr
+			}
+			for _, task := range tasks {
+				if task.Spec.GetContainer().Image == "image1" && task.DesiredState <= api.TaskStateRunning {
+					oldStillPresent = true
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, oldStillPresent, "old task should still be present while its replacement starts")
+	}
+
+	// Now update to image3 and trigger a rollback by failing the image3
+	// replacements, and make sure the rollback creates image2 tasks.
+	atomic.StoreUint32(&failImage3, 1)
+
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id2")
+		require.NotNil(t, s1)
+		s1.PreviousSpec = s1.Spec.Copy()
+		s1.UpdateStatus = nil
+		s1.Spec.Task.GetContainer().Image = "image3"
+		assert.NoError(t, store.UpdateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	for {
+		e := <-watchServiceUpdate
+		if e.(state.EventUpdateService).Service.UpdateStatus == nil {
+			continue
+		}
+		if e.(state.EventUpdateService).Service.UpdateStatus.State == api.UpdateStatus_ROLLBACK_STARTED {
+			break
+		}
+	}
+
+	observedTask := testutils.WatchTaskCreate(t, watchCreate)
+	assert.Equal(t, observedTask.Status.State, api.TaskStateNew)
+	assert.Equal(t, observedTask.Spec.GetContainer().Image, "image2")
+}
+
+// TestUpdaterRollbackUnhealthy is analogous to TestUpdaterRollback, but
+// fails tasks by reporting an unhealthy Docker healthcheck instead of
+// crashing them, and verifies that still counts toward MaxFailureRatio and
+// triggers a rollback.
+func TestUpdaterRollbackUnhealthy(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s)
+	defer orchestrator.Stop()
+
+	var failImage2 uint32
+
+	watchCreate, cancelCreate := state.Watch(s.WatchQueue(), state.EventCreateTask{})
+	defer cancelCreate()
+
+	watchServiceUpdate, cancelServiceUpdate := state.Watch(s.WatchQueue(), state.EventUpdateService{})
+	defer cancelServiceUpdate()
+
+	watchUpdate, cancelUpdate := state.Watch(s.WatchQueue(), state.EventUpdateTask{})
+	defer cancelUpdate()
+	go func() {
+		for {
+			select {
+			case e := <-watchUpdate:
+				task := e.(state.EventUpdateTask).Task
+				if task.DesiredState == task.Status.State {
+					continue
+				}
+				if task.DesiredState == api.TaskStateRunning && task.Status.State != api.TaskStateRunning && task.Status.HealthState == api.HealthCheckNone {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						if task.Spec.GetContainer().Image == "image2" && atomic.LoadUint32(&failImage2) == 1 {
+							task.Status.HealthState = api.HealthCheckFailure
+						} else {
+							task.Status.HealthState = api.HealthCheckSuccess
+						}
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				} else if task.DesiredState > api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				}
+			}
+		}
+	}()
+
+	err := s.Update(func(tx store.Tx) error {
+		s1 := &api.Service{
+			ID: "id3",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{
+					Name: "name3",
+				},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{
+						Container: &api.ContainerSpec{
+							Image: "image1",
+							Healthcheck: &api.HealthConfig{
+								Test: []string{"CMD-SHELL", "true"},
+							},
+						},
+					},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnNone,
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{
+					Replicated: &api.ReplicatedService{
+						Replicas: 4,
+					},
+				},
+				Update: &api.UpdateConfig{
+					FailureAction:   api.UpdateConfig_ROLLBACK,
+					Parallelism:     1,
+					Delay:           *ptypes.DurationProto(10 * time.Millisecond),
+					Monitor:         ptypes.DurationProto(500 * time.Millisecond),
+					MaxFailureRatio: 0.4,
+				},
+			},
+		}
+
+		assert.NoError(t, store.CreateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	go func() {
+		assert.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	for i := 0; i < 4; i++ {
+		testutils.WatchTaskCreate(t, watchCreate)
+	}
+
+	atomic.StoreUint32(&failImage2, 1)
+
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id3")
+		require.NotNil(t, s1)
+		s1.PreviousSpec = s1.Spec.Copy()
+		s1.UpdateStatus = nil
+		s1.Spec.Task.GetContainer().Image = "image2"
+		assert.NoError(t, store.UpdateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	for {
+		e := <-watchServiceUpdate
+		if e.(state.EventUpdateService).Service.UpdateStatus == nil {
+			continue
+		}
+		if e.(state.EventUpdateService).Service.UpdateStatus.State == api.UpdateStatus_ROLLBACK_STARTED {
+			break
+		}
+	}
+}
+
+// TestUpdaterCanary is analogous to TestUpdaterRollback, but selects the
+// Canary strategy: it should promote a fixed-size batch, then sit idle
+// until ResumeUpdate is called, and roll back if the resumed batch fails.
+func TestUpdaterCanary(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s)
+	defer orchestrator.Stop()
+
+	var failRest uint32
+
+	watchCreate, cancelCreate := state.Watch(s.WatchQueue(), state.EventCreateTask{})
+	defer cancelCreate()
+
+	watchServiceUpdate, cancelServiceUpdate := state.Watch(s.WatchQueue(), state.EventUpdateService{})
+	defer cancelServiceUpdate()
+
+	watchUpdate, cancelUpdate := state.Watch(s.WatchQueue(), state.EventUpdateTask{})
+	defer cancelUpdate()
+	go func() {
+		for {
+			select {
+			case e := <-watchUpdate:
+				task := e.(state.EventUpdateTask).Task
+				if task.DesiredState == task.Status.State {
+					continue
+				}
+				if task.DesiredState == api.TaskStateRunning && task.Status.State != api.TaskStateFailed && task.Status.State != api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						if task.Spec.GetContainer().Image == "image2" && atomic.LoadUint32(&failRest) == 1 {
+							task.Status.State = api.TaskStateFailed
+						} else {
+							task.Status.State = task.DesiredState
+						}
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				} else if task.DesiredState > api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				}
+			}
+		}
+	}()
+
+	err := s.Update(func(tx store.Tx) error {
+		s1 := &api.Service{
+			ID: "id4",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{
+					Name: "name4",
+				},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{
+						Container: &api.ContainerSpec{
+							Image: "image1",
+						},
+					},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnNone,
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{
+					Replicated: &api.ReplicatedService{
+						Replicas: 4,
+					},
+				},
+				Update: &api.UpdateConfig{
+					FailureAction:   api.UpdateConfig_ROLLBACK,
+					Delay:           *ptypes.DurationProto(10 * time.Millisecond),
+					Monitor:         ptypes.DurationProto(50 * time.Millisecond),
+					MaxFailureRatio: 0.4,
+					Strategy: &api.UpdateConfig_Canary{
+						Canary: &api.CanaryConfig{Count: 1},
+					},
+				},
+			},
+		}
+
+		assert.NoError(t, store.CreateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	go func() {
+		assert.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	for i := 0; i < 4; i++ {
+		testutils.WatchTaskCreate(t, watchCreate)
+	}
+
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id4")
+		require.NotNil(t, s1)
+		s1.PreviousSpec = s1.Spec.Copy()
+		s1.UpdateStatus = nil
+		s1.Spec.Task.GetContainer().Image = "image2"
+		assert.NoError(t, store.UpdateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// Only the canary batch (one task) should be promoted before the
+	// updater blocks waiting for ResumeUpdate.
+	observedTask := testutils.WatchTaskCreate(t, watchCreate)
+	assert.Equal(t, observedTask.Status.State, api.TaskStateNew)
+	assert.Equal(t, observedTask.Spec.GetContainer().Image, "image2")
+
+	select {
+	case <-watchCreate:
+		t.Fatal("updater should be paused after the canary batch, but created another task")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Resume, but fail the remaining batch so it rolls back.
+	atomic.StoreUint32(&failRest, 1)
+	orchestrator.ResumeUpdate("id4")
+
+	for {
+		e := <-watchServiceUpdate
+		if e.(state.EventUpdateService).Service.UpdateStatus == nil {
+			continue
+		}
+		if e.(state.EventUpdateService).Service.UpdateStatus.State == api.UpdateStatus_ROLLBACK_STARTED {
+			break
+		}
+	}
+}
+
+// TestUpdaterBlueGreen is analogous to TestUpdaterRollback, but selects the
+// BlueGreen strategy: every replacement task must exist and converge
+// before any old task is torn down, and a single failed replacement must
+// leave the old set running and trigger a rollback.
+func TestUpdaterBlueGreen(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s)
+	defer orchestrator.Stop()
+
+	var failOne uint32
+
+	watchCreate, cancelCreate := state.Watch(s.WatchQueue(), state.EventCreateTask{})
+	defer cancelCreate()
+
+	watchServiceUpdate, cancelServiceUpdate := state.Watch(s.WatchQueue(), state.EventUpdateService{})
+	defer cancelServiceUpdate()
+
+	watchUpdate, cancelUpdate := state.Watch(s.WatchQueue(), state.EventUpdateTask{})
+	defer cancelUpdate()
+	go func() {
+		failedOne := false
+		for {
+			select {
+			case e := <-watchUpdate:
+				task := e.(state.EventUpdateTask).Task
+				if task.DesiredState == task.Status.State {
+					continue
+				}
+				if task.DesiredState == api.TaskStateRunning && task.Status.State != api.TaskStateFailed && task.Status.State != api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						if task.Spec.GetContainer().Image == "image2" && atomic.LoadUint32(&failOne) == 1 && !failedOne {
+							task.Status.State = api.TaskStateFailed
+							failedOne = true
+						} else {
+							task.Status.State = task.DesiredState
+						}
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				} else if task.DesiredState > api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				}
+			}
+		}
+	}()
+
+	err := s.Update(func(tx store.Tx) error {
+		s1 := &api.Service{
+			ID: "id5",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{
+					Name: "name5",
+				},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{
+						Container: &api.ContainerSpec{
+							Image: "image1",
+						},
+					},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnNone,
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{
+					Replicated: &api.ReplicatedService{
+						Replicas: 3,
+					},
+				},
+				Update: &api.UpdateConfig{
+					FailureAction:   api.UpdateConfig_ROLLBACK,
+					Monitor:         ptypes.DurationProto(50 * time.Millisecond),
+					MaxFailureRatio: 0.1,
+					Strategy: &api.UpdateConfig_BlueGreen{
+						BlueGreen: &api.BlueGreenConfig{},
+					},
+				},
+			},
+		}
+
+		assert.NoError(t, store.CreateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	go func() {
+		assert.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	for i := 0; i < 3; i++ {
+		testutils.WatchTaskCreate(t, watchCreate)
+	}
+
+	atomic.StoreUint32(&failOne, 1)
+
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id5")
+		require.NotNil(t, s1)
+		s1.PreviousSpec = s1.Spec.Copy()
+		s1.UpdateStatus = nil
+		s1.Spec.Task.GetContainer().Image = "image2"
+		assert.NoError(t, store.UpdateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// All three replacements should be created up front, concurrently,
+	// rather than one at a time as in the rolling strategy.
+	for i := 0; i < 3; i++ {
+		observedTask := testutils.WatchTaskCreate(t, watchCreate)
+		assert.Equal(t, observedTask.Spec.GetContainer().Image, "image2")
+	}
+
+	for {
+		e := <-watchServiceUpdate
+		if e.(state.EventUpdateService).Service.UpdateStatus == nil {
+			continue
+		}
+		if e.(state.EventUpdateService).Service.UpdateStatus.State == api.UpdateStatus_ROLLBACK_STARTED {
+			break
+		}
+	}
+}
+
+// drainTaskCreates blocks until a task-create event arrives, then keeps
+// collecting them until settle elapses with no new one arriving, which
+// (given a Delay between batches longer than settle) corresponds to one
+// batch of an adaptive-parallelism update.
+func drainTaskCreates(watchCreate chan events.Event, settle time.Duration) []*api.Task {
+	tasks := []*api.Task{(<-watchCreate).(state.EventCreateTask).Task}
+	for {
+		select {
+		case e := <-watchCreate:
+			tasks = append(tasks, e.(state.EventCreateTask).Task)
+		case <-time.After(settle):
+			return tasks
+		}
+	}
+}
+
+// TestUpdaterAdaptiveParallelism is analogous to TestUpdaterRollback, but
+// enables AdaptiveParallelism and asserts that batch sizes observed via
+// EventCreateTask grow while batches succeed, and shrink once a batch
+// contains a failure.
+func TestUpdaterAdaptiveParallelism(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+	defer s.Close()
+
+	orchestrator := NewReplicatedOrchestrator(s)
+	defer orchestrator.Stop()
+
+	var failOneAt int32 = -1
+	var seen int32
+
+	watchCreate, cancelCreate := state.Watch(s.WatchQueue(), state.EventCreateTask{})
+	defer cancelCreate()
+
+	watchUpdate, cancelUpdate := state.Watch(s.WatchQueue(), state.EventUpdateTask{})
+	defer cancelUpdate()
+	go func() {
+		for {
+			select {
+			case e := <-watchUpdate:
+				task := e.(state.EventUpdateTask).Task
+				if task.DesiredState == task.Status.State {
+					continue
+				}
+				if task.DesiredState == api.TaskStateRunning && task.Status.State != api.TaskStateFailed && task.Status.State != api.TaskStateRunning {
+					idx := atomic.AddInt32(&seen, 1) - 1
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						if task.Spec.GetContainer().Image == "image2" && idx == atomic.LoadInt32(&failOneAt) {
+							task.Status.State = api.TaskStateFailed
+						} else {
+							task.Status.State = task.DesiredState
+						}
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				} else if task.DesiredState > api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				}
+			}
+		}
+	}()
+
+	err := s.Update(func(tx store.Tx) error {
+		s1 := &api.Service{
+			ID: "id6",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{
+					Name: "name6",
+				},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{
+						Container: &api.ContainerSpec{
+							Image: "image1",
+						},
+					},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnNone,
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{
+					Replicated: &api.ReplicatedService{
+						Replicas: 16,
+					},
+				},
+				Update: &api.UpdateConfig{
+					FailureAction:       api.UpdateConfig_ROLLBACK,
+					Delay:               *ptypes.DurationProto(300 * time.Millisecond),
+					AdaptiveParallelism: true,
+					MaxParallelism:      8,
+					MaxFailureRatio:     0.5,
+				},
+			},
+		}
+
+		assert.NoError(t, store.CreateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	go func() {
+		assert.NoError(t, orchestrator.Run(ctx))
+	}()
+
+	// Drain the initial replica creation.
+	drainTaskCreates(watchCreate, 200*time.Millisecond)
+
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id6")
+		require.NotNil(t, s1)
+		s1.PreviousSpec = s1.Spec.Copy()
+		s1.UpdateStatus = nil
+		s1.Spec.Task.GetContainer().Image = "image2"
+		assert.NoError(t, store.UpdateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// The first two batches should grow: size 1, then size 2.
+	batch1 := drainTaskCreates(watchCreate, 100*time.Millisecond)
+	assert.Len(t, batch1, 1)
+
+	batch2 := drainTaskCreates(watchCreate, 100*time.Millisecond)
+	assert.Len(t, batch2, 2)
+
+	// Fail one task in the next batch (expected size 4) to force a
+	// shrink on the batch after it.
+	atomic.StoreInt32(&failOneAt, atomic.LoadInt32(&seen))
+
+	batch3 := drainTaskCreates(watchCreate, 100*time.Millisecond)
+	assert.Len(t, batch3, 4)
+
+	batch4 := drainTaskCreates(watchCreate, 100*time.Millisecond)
+	assert.True(t, len(batch4) > 0 && len(batch4) < len(batch3), "batch size should shrink after a failure")
+}
+
+// TestUpdaterResumeAfterRestart is analogous to TestUpdaterRollback, but
+// stops the orchestrator mid-update (simulating a manager restart) and
+// starts a fresh one against the same store, verifying the update resumes
+// from the persisted UpdateStatus.History instead of re-scheduling slots
+// that already converged.
+func TestUpdaterResumeAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+	defer s.Close()
+
+	watchCreate, cancelCreate := state.Watch(s.WatchQueue(), state.EventCreateTask{})
+	defer cancelCreate()
+
+	watchUpdate, cancelUpdate := state.Watch(s.WatchQueue(), state.EventUpdateTask{})
+	defer cancelUpdate()
+	go func() {
+		for {
+			select {
+			case e := <-watchUpdate:
+				task := e.(state.EventUpdateTask).Task
+				if task.DesiredState == task.Status.State {
+					continue
+				}
+				if task.DesiredState == api.TaskStateRunning && task.Status.State != api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				} else if task.DesiredState > api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				}
+			}
+		}
+	}()
+
+	err := s.Update(func(tx store.Tx) error {
+		s1 := &api.Service{
+			ID: "id7",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{
+					Name: "name7",
+				},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{
+						Container: &api.ContainerSpec{
+							Image: "image1",
+						},
+					},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnNone,
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{
+					Replicated: &api.ReplicatedService{
+						Replicas: 4,
+					},
+				},
+				Update: &api.UpdateConfig{
+					Parallelism: 1,
+					Delay:       *ptypes.DurationProto(30 * time.Millisecond),
+				},
+			},
+		}
+
+		assert.NoError(t, store.CreateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	orchestrator1 := NewReplicatedOrchestrator(s)
+	go func() {
+		assert.NoError(t, orchestrator1.Run(ctx))
+	}()
+
+	for i := 0; i < 4; i++ {
+		testutils.WatchTaskCreate(t, watchCreate)
+	}
+
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id7")
+		require.NotNil(t, s1)
+		s1.PreviousSpec = s1.Spec.Copy()
+		s1.UpdateStatus = nil
+		s1.Spec.Task.GetContainer().Image = "image2"
+		assert.NoError(t, store.UpdateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// Let the first batch (one task) go through, then kill the
+	// orchestrator, simulating a manager restart mid-update.
+	observedTask := testutils.WatchTaskCreate(t, watchCreate)
+	assert.Equal(t, observedTask.Spec.GetContainer().Image, "image2")
+
+	orchestrator1.Stop()
+
+	var history []*api.UpdatePhase
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id7")
+		require.NotNil(t, s1)
+		require.NotNil(t, s1.UpdateStatus)
+		history = s1.UpdateStatus.History
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, history, "update progress should have been persisted to UpdateStatus.History")
+
+	// Start a fresh orchestrator against the same store. It should pick
+	// up where the last one left off rather than recreating the task the
+	// first orchestrator already converged.
+	orchestrator2 := NewReplicatedOrchestrator(s)
+	defer orchestrator2.Stop()
+	go func() {
+		assert.NoError(t, orchestrator2.Run(ctx))
+	}()
+
+	for i := 0; i < 3; i++ {
+		observedTask = testutils.WatchTaskCreate(t, watchCreate)
+		assert.Equal(t, observedTask.Spec.GetContainer().Image, "image2")
+	}
+
+	err = s.Update(func(tx store.Tx) error {
+		tasks, findErr := store.FindTasks(tx, store.ByServiceID("id7"))
+		if findErr != nil {
+			return findErr
+		}
+		var image2Count int
+		for _, task := range tasks {
+			if task.Spec.GetContainer().Image == "image2" {
+				image2Count++
+			}
+		}
+		assert.Equal(t, 4, image2Count, "each slot should have exactly one image2 replacement, not double-scheduled")
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+// TestUpdaterResumeAfterRestartAdaptiveParallelism is analogous to
+// TestUpdaterResumeAfterRestart, but enables AdaptiveParallelism and kills
+// the orchestrator mid-batch instead of between batches, verifying that
+// the batch size the second orchestrator resumes at is the one
+// resumeBatchSize derives from the journal -- half the interrupted
+// batch's size, per its "no matching BATCH_COMPLETED" rule -- rather than
+// always restarting AIMD at 1.
+func TestUpdaterResumeAfterRestartAdaptiveParallelism(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+	defer s.Close()
+
+	// Let only the first three image2 tasks converge (the size-1 and
+	// size-2 batches); the size-4 batch after them is left stuck at New,
+	// simulating a manager restart partway through it.
+	var converged int32
+
+	watchCreate, cancelCreate := state.Watch(s.WatchQueue(), state.EventCreateTask{})
+	defer cancelCreate()
+
+	watchUpdate, cancelUpdate := state.Watch(s.WatchQueue(), state.EventUpdateTask{})
+	defer cancelUpdate()
+	go func() {
+		for {
+			select {
+			case e := <-watchUpdate:
+				task := e.(state.EventUpdateTask).Task
+				if task.DesiredState == task.Status.State {
+					continue
+				}
+				if task.DesiredState == api.TaskStateRunning && task.Status.State != api.TaskStateRunning {
+					if task.Spec.GetContainer().Image == "image2" && atomic.LoadInt32(&converged) >= 3 {
+						continue
+					}
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+					if task.Spec.GetContainer().Image == "image2" {
+						atomic.AddInt32(&converged, 1)
+					}
+				} else if task.DesiredState > api.TaskStateRunning {
+					err := s.Update(func(tx store.Tx) error {
+						task = store.GetTask(tx, task.ID)
+						task.Status.State = task.DesiredState
+						return store.UpdateTask(tx, task)
+					})
+					assert.NoError(t, err)
+				}
+			}
+		}
+	}()
+
+	err := s.Update(func(tx store.Tx) error {
+		s1 := &api.Service{
+			ID: "id8",
+			Spec: api.ServiceSpec{
+				Annotations: api.Annotations{
+					Name: "name8",
+				},
+				Task: api.TaskSpec{
+					Runtime: &api.TaskSpec_Container{
+						Container: &api.ContainerSpec{
+							Image: "image1",
+						},
+					},
+					Restart: &api.RestartPolicy{
+						Condition: api.RestartOnNone,
+					},
+				},
+				Mode: &api.ServiceSpec_Replicated{
+					Replicated: &api.ReplicatedService{
+						Replicas: 16,
+					},
+				},
+				Update: &api.UpdateConfig{
+					Delay:               *ptypes.DurationProto(500 * time.Millisecond),
+					AdaptiveParallelism: true,
+					MaxParallelism:      8,
+				},
+			},
+		}
+
+		assert.NoError(t, store.CreateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	orchestrator1 := NewReplicatedOrchestrator(s)
+	go func() {
+		assert.NoError(t, orchestrator1.Run(ctx))
+	}()
+
+	drainTaskCreates(watchCreate, 200*time.Millisecond)
+
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id8")
+		require.NotNil(t, s1)
+		s1.PreviousSpec = s1.Spec.Copy()
+		s1.UpdateStatus = nil
+		s1.Spec.Task.GetContainer().Image = "image2"
+		assert.NoError(t, store.UpdateService(tx, s1))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// Batch sizes 1, then 2, converge; the watcher above then stops
+	// advancing image2 tasks, so the size-4 batch after them is created
+	// but never converges.
+	batch1 := drainTaskCreates(watchCreate, 200*time.Millisecond)
+	assert.Len(t, batch1, 1)
+
+	batch2 := drainTaskCreates(watchCreate, 200*time.Millisecond)
+	assert.Len(t, batch2, 2)
+
+	batch3 := drainTaskCreates(watchCreate, 200*time.Millisecond)
+	assert.Len(t, batch3, 4)
+
+	// The size-4 batch is now stuck waiting for its tasks to converge.
+	// Kill the orchestrator, simulating a manager restart mid-batch.
+	orchestrator1.Stop()
+
+	var history []*api.UpdatePhase
+	err = s.Update(func(tx store.Tx) error {
+		s1 := store.GetService(tx, "id8")
+		require.NotNil(t, s1)
+		require.NotNil(t, s1.UpdateStatus)
+		history = s1.UpdateStatus.History
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, resumeBatchSize(history, 8), "the interrupted size-4 batch never recorded BATCH_COMPLETED, so resumeBatchSize should halve it rather than double it")
+
+	// Start a fresh orchestrator against the same store. It should resume
+	// AIMD at the batch size resumeBatchSize derives from the journal --
+	// half of the interrupted batch's size -- not reset to 1.
+	orchestrator2 := NewReplicatedOrchestrator(s)
+	defer orchestrator2.Stop()
+	go func() {
+		assert.NoError(t, orchestrator2.Run(ctx))
+	}()
+
+	batch4 := drainTaskCreates(watchCreate, 200*time.Millisecond)
+	assert.Len(t, batch4, 2, "batch size should resume at half the interrupted batch's size")
+}
@@ -0,0 +1,67 @@
+package replicated
+
+import (
+	"fmt"
+
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/manager/state"
+	"github.com/docker/swarmkit/manager/state/store"
+	"golang.org/x/net/context"
+)
+
+// WatchUpdateHistory streams the persisted phase history for a service's
+// update -- UpdateStatus.History -- to onPhase: first everything recorded
+// so far, then each new phase as recordPhase appends one, until ctx is
+// cancelled or the service is deleted. This is the logic the
+// ServiceControl.WatchServiceUpdate RPC handler streams to its client;
+// it's kept here, independent of the generated gRPC stream type, so it can
+// be exercised without it.
+func WatchUpdateHistory(ctx context.Context, s *store.MemoryStore, serviceID string, onPhase func(*api.UpdatePhase) error) error {
+	var service *api.Service
+	s.View(func(tx store.ReadTx) {
+		service = store.GetService(tx, serviceID)
+	})
+	if service == nil {
+		return fmt.Errorf("service %s not found", serviceID)
+	}
+
+	sent := 0
+	if service.UpdateStatus != nil {
+		for _, phase := range service.UpdateStatus.History {
+			if err := onPhase(phase); err != nil {
+				return err
+			}
+			sent++
+		}
+	}
+
+	updates, cancel := state.Watch(s.WatchQueue(),
+		state.EventUpdateService{Service: &api.Service{ID: serviceID}},
+		state.EventDeleteService{Service: &api.Service{ID: serviceID}},
+	)
+	defer cancel()
+
+	for {
+		select {
+		case e := <-updates:
+			if deleted, ok := e.(state.EventDeleteService); ok {
+				if deleted.Service.ID == serviceID {
+					return nil
+				}
+				continue
+			}
+			updated := e.(state.EventUpdateService).Service
+			if updated.ID != serviceID || updated.UpdateStatus == nil || len(updated.UpdateStatus.History) <= sent {
+				continue
+			}
+			for _, phase := range updated.UpdateStatus.History[sent:] {
+				if err := onPhase(phase); err != nil {
+					return err
+				}
+			}
+			sent = len(updated.UpdateStatus.History)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}